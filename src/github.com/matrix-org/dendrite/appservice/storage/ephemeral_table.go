@@ -0,0 +1,124 @@
+// Copyright 2018 Vector Creations Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+)
+
+// ephemeralSchema queues typing, receipt and presence updates destined for
+// an application service, the same way appservice_events queues PDUs.
+//
+// This table only provides the queue itself: inserting into it, reading it
+// back into a transaction, and removing delivered/quarantined rows. Nothing
+// in this repository calls InsertEphemeralEvent - wiring the typing server,
+// read receipts and presence components to actually produce these updates
+// is separate, not-yet-scoped follow-up work, and is not part of what this
+// table delivers.
+const ephemeralSchema = `
+CREATE TABLE IF NOT EXISTS appservice_ephemeral_events (
+	id BIGSERIAL PRIMARY KEY,
+	as_id TEXT NOT NULL,
+	ephemeral_json TEXT NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS appservice_ephemeral_events_as_id ON appservice_ephemeral_events(as_id);
+`
+
+const insertEphemeralEventSQL = "" +
+	"INSERT INTO appservice_ephemeral_events (as_id, ephemeral_json) VALUES ($1, $2)"
+
+const selectEphemeralEventsWithAppServiceIDSQL = "" +
+	"SELECT id, ephemeral_json FROM appservice_ephemeral_events" +
+	" WHERE as_id = $1 ORDER BY id ASC LIMIT $2"
+
+const deleteEphemeralEventsBeforeAndIncludingIDSQL = "" +
+	"DELETE FROM appservice_ephemeral_events WHERE as_id = $1 AND id <= $2"
+
+type ephemeralStatements struct {
+	db                                            *sql.DB
+	insertEphemeralEventStmt                      *sql.Stmt
+	selectEphemeralEventsWithAppServiceIDStmt     *sql.Stmt
+	deleteEphemeralEventsBeforeAndIncludingIDStmt *sql.Stmt
+}
+
+func (s *ephemeralStatements) prepare(db *sql.DB) (err error) {
+	s.db = db
+
+	if _, err = db.Exec(ephemeralSchema); err != nil {
+		return err
+	}
+
+	if s.insertEphemeralEventStmt, err = db.Prepare(insertEphemeralEventSQL); err != nil {
+		return err
+	}
+	if s.selectEphemeralEventsWithAppServiceIDStmt, err = db.Prepare(selectEphemeralEventsWithAppServiceIDSQL); err != nil {
+		return err
+	}
+	if s.deleteEphemeralEventsBeforeAndIncludingIDStmt, err = db.Prepare(deleteEphemeralEventsBeforeAndIncludingIDSQL); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// InsertEphemeralEvent queues a single ephemeral update (typing, receipt or
+// presence) for delivery to an application service.
+func (d *Database) InsertEphemeralEvent(
+	ctx context.Context, appserviceID string, ephemeralJSON json.RawMessage,
+) error {
+	_, err := d.ephemeral.insertEphemeralEventStmt.ExecContext(ctx, appserviceID, string(ephemeralJSON))
+	return err
+}
+
+// GetEphemeralEventsWithAppServiceID returns up to `limit` queued ephemeral
+// events (typing, receipts, presence) for the given application service,
+// along with the ID of the last one returned.
+func (d *Database) GetEphemeralEventsWithAppServiceID(
+	ctx context.Context, appserviceID string, limit int,
+) (maxID int, events []json.RawMessage, err error) {
+	rows, err := d.ephemeral.selectEphemeralEventsWithAppServiceIDStmt.QueryContext(ctx, appserviceID, limit)
+	if err != nil {
+		return
+	}
+	defer func() {
+		if cerr := rows.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}()
+
+	for rows.Next() {
+		var id int
+		var ephemeralJSON string
+		if err = rows.Scan(&id, &ephemeralJSON); err != nil {
+			return
+		}
+		events = append(events, json.RawMessage(ephemeralJSON))
+		maxID = id
+	}
+
+	return maxID, events, rows.Err()
+}
+
+// RemoveEphemeralEventsBeforeAndIncludingID removes all ephemeral events for
+// an application service up to and including a given maximum ID.
+func (d *Database) RemoveEphemeralEventsBeforeAndIncludingID(
+	ctx context.Context, appserviceID string, maxID int,
+) error {
+	_, err := d.ephemeral.deleteEphemeralEventsBeforeAndIncludingIDStmt.ExecContext(ctx, appserviceID, maxID)
+	return err
+}
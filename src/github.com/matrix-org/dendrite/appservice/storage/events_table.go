@@ -0,0 +1,146 @@
+// Copyright 2018 Vector Creations Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+const eventsSchema = `
+CREATE TABLE IF NOT EXISTS appservice_events (
+	id BIGSERIAL PRIMARY KEY,
+	as_id TEXT NOT NULL,
+	txn_id BIGINT NOT NULL DEFAULT -1,
+	event_json TEXT NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS appservice_events_as_id ON appservice_events(as_id);
+`
+
+const countEventsWithAppServiceIDSQL = "" +
+	"SELECT COUNT(*) FROM appservice_events WHERE as_id = $1"
+
+const selectEventsWithAppServiceIDSQL = "" +
+	"SELECT id, txn_id, event_json FROM appservice_events" +
+	" WHERE as_id = $1 ORDER BY id ASC LIMIT $2"
+
+const updateTxnIDForEventsSQL = "" +
+	"UPDATE appservice_events SET txn_id = $1" +
+	" WHERE as_id = $2 AND id <= $3 AND txn_id = -1"
+
+const deleteEventsBeforeAndIncludingIDSQL = "" +
+	"DELETE FROM appservice_events WHERE as_id = $1 AND id <= $2"
+
+type eventsStatements struct {
+	db                                   *sql.DB
+	countEventsWithAppServiceIDStmt      *sql.Stmt
+	selectEventsWithAppServiceIDStmt     *sql.Stmt
+	updateTxnIDForEventsStmt             *sql.Stmt
+	deleteEventsBeforeAndIncludingIDStmt *sql.Stmt
+}
+
+func (s *eventsStatements) prepare(db *sql.DB) (err error) {
+	s.db = db
+
+	if _, err = db.Exec(eventsSchema); err != nil {
+		return err
+	}
+
+	if s.countEventsWithAppServiceIDStmt, err = db.Prepare(countEventsWithAppServiceIDSQL); err != nil {
+		return err
+	}
+	if s.selectEventsWithAppServiceIDStmt, err = db.Prepare(selectEventsWithAppServiceIDSQL); err != nil {
+		return err
+	}
+	if s.updateTxnIDForEventsStmt, err = db.Prepare(updateTxnIDForEventsSQL); err != nil {
+		return err
+	}
+	if s.deleteEventsBeforeAndIncludingIDStmt, err = db.Prepare(deleteEventsBeforeAndIncludingIDSQL); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// CountEventsWithAppServiceID returns the number of events currently queued
+// for the given application service.
+func (d *Database) CountEventsWithAppServiceID(
+	ctx context.Context, appserviceID string,
+) (count int, err error) {
+	err = d.events.countEventsWithAppServiceIDStmt.QueryRowContext(ctx, appserviceID).Scan(&count)
+	return
+}
+
+// GetEventsWithAppServiceID returns up to `limit` events queued for the
+// given application service, along with the transaction ID they have been
+// batched under (-1 if they have not yet been assigned one) and the ID of
+// the last event returned.
+func (d *Database) GetEventsWithAppServiceID(
+	ctx context.Context, appserviceID string, limit int,
+) (txnID, maxID int, events []gomatrixserverlib.ApplicationServiceEvent, err error) {
+	txnID = -1
+
+	rows, err := d.events.selectEventsWithAppServiceIDStmt.QueryContext(ctx, appserviceID, limit)
+	if err != nil {
+		return
+	}
+	defer func() {
+		if cerr := rows.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}()
+
+	for rows.Next() {
+		var id int
+		var rowTxnID int
+		var eventJSON string
+		if err = rows.Scan(&id, &rowTxnID, &eventJSON); err != nil {
+			return
+		}
+
+		var event gomatrixserverlib.ApplicationServiceEvent
+		if err = json.Unmarshal([]byte(eventJSON), &event); err != nil {
+			return
+		}
+
+		events = append(events, event)
+		txnID = rowTxnID
+		maxID = id
+	}
+
+	return txnID, maxID, events, rows.Err()
+}
+
+// UpdateTxnIDForEvents marks all as-yet-unassigned events up to and
+// including maxID as belonging to txnID.
+func (d *Database) UpdateTxnIDForEvents(
+	ctx context.Context, appserviceID string, maxID, txnID int,
+) error {
+	_, err := d.events.updateTxnIDForEventsStmt.ExecContext(ctx, txnID, appserviceID, maxID)
+	return err
+}
+
+// RemoveEventsBeforeAndIncludingID removes all events for an application
+// service up to and including a given maximum ID.
+func (d *Database) RemoveEventsBeforeAndIncludingID(
+	ctx context.Context, appserviceID string, maxID int,
+) error {
+	_, err := d.events.deleteEventsBeforeAndIncludingIDStmt.ExecContext(ctx, appserviceID, maxID)
+	return err
+}
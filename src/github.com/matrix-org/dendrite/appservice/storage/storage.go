@@ -0,0 +1,63 @@
+// Copyright 2018 Vector Creations Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"database/sql"
+
+	// Import the postgres database driver.
+	_ "github.com/lib/pq"
+)
+
+// Database represents an application service database, storing queued
+// events, transaction bookkeeping and delivery retry state for each
+// configured application service.
+type Database struct {
+	db           *sql.DB
+	events       eventsStatements
+	txn          txnStatements
+	transactions transactionsStatements
+	ephemeral    ephemeralStatements
+	toDevice     toDeviceStatements
+}
+
+// NewDatabase opens a new database connection for application services
+// and sets up all prepared statements required for operation.
+func NewDatabase(dataSourceName string) (*Database, error) {
+	db, err := sql.Open("postgres", dataSourceName)
+	if err != nil {
+		return nil, err
+	}
+
+	d := &Database{db: db}
+
+	if err = d.events.prepare(db); err != nil {
+		return nil, err
+	}
+	if err = d.txn.prepare(db); err != nil {
+		return nil, err
+	}
+	if err = d.transactions.prepare(db); err != nil {
+		return nil, err
+	}
+	if err = d.ephemeral.prepare(db); err != nil {
+		return nil, err
+	}
+	if err = d.toDevice.prepare(db); err != nil {
+		return nil, err
+	}
+
+	return d, nil
+}
@@ -0,0 +1,124 @@
+// Copyright 2018 Vector Creations Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+)
+
+// toDeviceSchema queues to-device messages destined for an application
+// service, the same way appservice_events queues PDUs.
+//
+// This table only provides the queue itself: inserting into it, reading it
+// back into a transaction, and removing delivered/quarantined rows. Nothing
+// in this repository calls InsertToDeviceMessage - producing the to-device
+// messages an application service should receive and calling it from
+// wherever they originate is separate, not-yet-scoped follow-up work, and
+// is not part of what this table delivers.
+const toDeviceSchema = `
+CREATE TABLE IF NOT EXISTS appservice_to_device_messages (
+	id BIGSERIAL PRIMARY KEY,
+	as_id TEXT NOT NULL,
+	message_json TEXT NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS appservice_to_device_messages_as_id ON appservice_to_device_messages(as_id);
+`
+
+const insertToDeviceMessageSQL = "" +
+	"INSERT INTO appservice_to_device_messages (as_id, message_json) VALUES ($1, $2)"
+
+const selectToDeviceMessagesWithAppServiceIDSQL = "" +
+	"SELECT id, message_json FROM appservice_to_device_messages" +
+	" WHERE as_id = $1 ORDER BY id ASC LIMIT $2"
+
+const deleteToDeviceMessagesBeforeAndIncludingIDSQL = "" +
+	"DELETE FROM appservice_to_device_messages WHERE as_id = $1 AND id <= $2"
+
+type toDeviceStatements struct {
+	db                                             *sql.DB
+	insertToDeviceMessageStmt                      *sql.Stmt
+	selectToDeviceMessagesWithAppServiceIDStmt     *sql.Stmt
+	deleteToDeviceMessagesBeforeAndIncludingIDStmt *sql.Stmt
+}
+
+func (s *toDeviceStatements) prepare(db *sql.DB) (err error) {
+	s.db = db
+
+	if _, err = db.Exec(toDeviceSchema); err != nil {
+		return err
+	}
+
+	if s.insertToDeviceMessageStmt, err = db.Prepare(insertToDeviceMessageSQL); err != nil {
+		return err
+	}
+	if s.selectToDeviceMessagesWithAppServiceIDStmt, err = db.Prepare(selectToDeviceMessagesWithAppServiceIDSQL); err != nil {
+		return err
+	}
+	if s.deleteToDeviceMessagesBeforeAndIncludingIDStmt, err = db.Prepare(deleteToDeviceMessagesBeforeAndIncludingIDSQL); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// InsertToDeviceMessage queues a single to-device message for delivery to
+// an application service.
+func (d *Database) InsertToDeviceMessage(
+	ctx context.Context, appserviceID string, messageJSON json.RawMessage,
+) error {
+	_, err := d.toDevice.insertToDeviceMessageStmt.ExecContext(ctx, appserviceID, string(messageJSON))
+	return err
+}
+
+// GetToDeviceMessagesWithAppServiceID returns up to `limit` queued to-device
+// messages for the given application service, along with the ID of the last
+// one returned.
+func (d *Database) GetToDeviceMessagesWithAppServiceID(
+	ctx context.Context, appserviceID string, limit int,
+) (maxID int, messages []json.RawMessage, err error) {
+	rows, err := d.toDevice.selectToDeviceMessagesWithAppServiceIDStmt.QueryContext(ctx, appserviceID, limit)
+	if err != nil {
+		return
+	}
+	defer func() {
+		if cerr := rows.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}()
+
+	for rows.Next() {
+		var id int
+		var messageJSON string
+		if err = rows.Scan(&id, &messageJSON); err != nil {
+			return
+		}
+		messages = append(messages, json.RawMessage(messageJSON))
+		maxID = id
+	}
+
+	return maxID, messages, rows.Err()
+}
+
+// RemoveToDeviceMessagesBeforeAndIncludingID removes all to-device messages
+// for an application service up to and including a given maximum ID.
+func (d *Database) RemoveToDeviceMessagesBeforeAndIncludingID(
+	ctx context.Context, appserviceID string, maxID int,
+) error {
+	_, err := d.toDevice.deleteToDeviceMessagesBeforeAndIncludingIDStmt.ExecContext(ctx, appserviceID, maxID)
+	return err
+}
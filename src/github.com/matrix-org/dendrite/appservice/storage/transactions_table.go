@@ -0,0 +1,233 @@
+// Copyright 2018 Vector Creations Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/matrix-org/dendrite/appservice/types"
+)
+
+// transactionsSchema tracks each application service transaction as a
+// first-class row so that delivery progress, retry state and dead-lettering
+// survive a worker restart instead of living only in goroutine-local state.
+const transactionsSchema = `
+CREATE TABLE IF NOT EXISTS appservice_transactions (
+	as_id TEXT NOT NULL,
+	txn_id BIGINT NOT NULL,
+	payload TEXT NOT NULL,
+	max_event_id BIGINT NOT NULL DEFAULT 0,
+	ephemeral_max_id BIGINT NOT NULL DEFAULT 0,
+	to_device_max_id BIGINT NOT NULL DEFAULT 0,
+	events_count BIGINT NOT NULL DEFAULT 0,
+	attempt_count BIGINT NOT NULL DEFAULT 0,
+	next_attempt_at BIGINT NOT NULL DEFAULT 0,
+	last_error TEXT NOT NULL DEFAULT '',
+	state TEXT NOT NULL DEFAULT 'pending',
+	PRIMARY KEY (as_id, txn_id)
+);
+
+CREATE INDEX IF NOT EXISTS appservice_transactions_state ON appservice_transactions(as_id, state);
+`
+
+const upsertTransactionSQL = "" +
+	"INSERT INTO appservice_transactions" +
+	" (as_id, txn_id, payload, max_event_id, ephemeral_max_id, to_device_max_id, events_count, attempt_count, next_attempt_at, last_error, state)" +
+	" VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)" +
+	" ON CONFLICT (as_id, txn_id) DO UPDATE SET" +
+	" payload = $3, max_event_id = $4, ephemeral_max_id = $5, to_device_max_id = $6, events_count = $7," +
+	" attempt_count = $8, next_attempt_at = $9, last_error = $10, state = $11"
+
+const selectPendingTransactionsSQL = "" +
+	"SELECT txn_id, payload, max_event_id, ephemeral_max_id, to_device_max_id, events_count, attempt_count, next_attempt_at, last_error, state" +
+	" FROM appservice_transactions WHERE as_id = $1 AND state != 'dead_letter' ORDER BY txn_id ASC"
+
+const selectDeadLetteredTransactionsSQL = "" +
+	"SELECT txn_id, payload, max_event_id, ephemeral_max_id, to_device_max_id, events_count, attempt_count, next_attempt_at, last_error, state" +
+	" FROM appservice_transactions WHERE as_id = $1 AND state = 'dead_letter' ORDER BY txn_id ASC"
+
+const selectTransactionSQL = "" +
+	"SELECT txn_id, payload, max_event_id, ephemeral_max_id, to_device_max_id, events_count, attempt_count, next_attempt_at, last_error, state" +
+	" FROM appservice_transactions WHERE as_id = $1 AND txn_id = $2"
+
+const updateTransactionStateSQL = "" +
+	"UPDATE appservice_transactions SET attempt_count = $1, next_attempt_at = $2, last_error = $3, state = $4" +
+	" WHERE as_id = $5 AND txn_id = $6"
+
+const deleteTransactionSQL = "" +
+	"DELETE FROM appservice_transactions WHERE as_id = $1 AND txn_id = $2"
+
+type transactionsStatements struct {
+	db                                 *sql.DB
+	upsertTransactionStmt              *sql.Stmt
+	selectPendingTransactionsStmt      *sql.Stmt
+	selectDeadLetteredTransactionsStmt *sql.Stmt
+	selectTransactionStmt              *sql.Stmt
+	updateTransactionStateStmt         *sql.Stmt
+	deleteTransactionStmt              *sql.Stmt
+}
+
+func (s *transactionsStatements) prepare(db *sql.DB) (err error) {
+	s.db = db
+
+	if _, err = db.Exec(transactionsSchema); err != nil {
+		return err
+	}
+
+	if s.upsertTransactionStmt, err = db.Prepare(upsertTransactionSQL); err != nil {
+		return err
+	}
+	if s.selectPendingTransactionsStmt, err = db.Prepare(selectPendingTransactionsSQL); err != nil {
+		return err
+	}
+	if s.selectDeadLetteredTransactionsStmt, err = db.Prepare(selectDeadLetteredTransactionsSQL); err != nil {
+		return err
+	}
+	if s.selectTransactionStmt, err = db.Prepare(selectTransactionSQL); err != nil {
+		return err
+	}
+	if s.updateTransactionStateStmt, err = db.Prepare(updateTransactionStateSQL); err != nil {
+		return err
+	}
+	if s.deleteTransactionStmt, err = db.Prepare(deleteTransactionSQL); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// UpsertQueuedTransaction persists (or updates) a single queued transaction
+// for an application service.
+func (d *Database) UpsertQueuedTransaction(
+	ctx context.Context, appserviceID string, txn types.QueuedTransaction,
+) error {
+	_, err := d.transactions.upsertTransactionStmt.ExecContext(
+		ctx, appserviceID, txn.TxnID, string(txn.Payload),
+		txn.MaxEventID, txn.EphemeralMaxID, txn.ToDeviceMaxID, txn.EventsCount,
+		txn.AttemptCount, txn.NextAttemptAt.Unix(), txn.LastError, string(txn.Status),
+	)
+	return err
+}
+
+// GetPendingTransactions returns every non-dead-lettered transaction queued
+// for an application service, including ones left partially sent from a
+// previous run, ordered oldest-first so delivery order is preserved.
+func (d *Database) GetPendingTransactions(
+	ctx context.Context, appserviceID string,
+) ([]types.QueuedTransaction, error) {
+	return d.queryTransactions(ctx, d.transactions.selectPendingTransactionsStmt, appserviceID)
+}
+
+// GetDeadLetteredTransactions returns every transaction that has been moved
+// to the dead_letter state for an application service.
+func (d *Database) GetDeadLetteredTransactions(
+	ctx context.Context, appserviceID string,
+) ([]types.QueuedTransaction, error) {
+	return d.queryTransactions(ctx, d.transactions.selectDeadLetteredTransactionsStmt, appserviceID)
+}
+
+// GetQueuedTransaction returns a single queued transaction for an
+// application service, regardless of its state. Used to re-read a
+// transaction's payload after it has been moved back to pending, e.g. by
+// RequeueDeadLetteredTransaction.
+func (d *Database) GetQueuedTransaction(
+	ctx context.Context, appserviceID string, txnID int,
+) (txn types.QueuedTransaction, err error) {
+	var payload string
+	var nextAttemptAt int64
+	var state string
+	row := d.transactions.selectTransactionStmt.QueryRowContext(ctx, appserviceID, txnID)
+	if err = row.Scan(
+		&txn.TxnID, &payload, &txn.MaxEventID, &txn.EphemeralMaxID, &txn.ToDeviceMaxID, &txn.EventsCount,
+		&txn.AttemptCount, &nextAttemptAt, &txn.LastError, &state,
+	); err != nil {
+		return types.QueuedTransaction{}, err
+	}
+
+	txn.AppServiceID = appserviceID
+	txn.Payload = []byte(payload)
+	txn.NextAttemptAt = time.Unix(nextAttemptAt, 0)
+	txn.Status = types.TransactionStatus(state)
+	return txn, nil
+}
+
+func (d *Database) queryTransactions(
+	ctx context.Context, stmt *sql.Stmt, appserviceID string,
+) (txns []types.QueuedTransaction, err error) {
+	rows, err := stmt.QueryContext(ctx, appserviceID)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if cerr := rows.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}()
+
+	for rows.Next() {
+		var txn types.QueuedTransaction
+		var payload string
+		var nextAttemptAt int64
+		var state string
+		if err = rows.Scan(
+			&txn.TxnID, &payload, &txn.MaxEventID, &txn.EphemeralMaxID, &txn.ToDeviceMaxID, &txn.EventsCount,
+			&txn.AttemptCount, &nextAttemptAt, &txn.LastError, &state,
+		); err != nil {
+			return nil, err
+		}
+		txn.AppServiceID = appserviceID
+		txn.Payload = []byte(payload)
+		txn.NextAttemptAt = time.Unix(nextAttemptAt, 0)
+		txn.Status = types.TransactionStatus(state)
+		txns = append(txns, txn)
+	}
+
+	return txns, rows.Err()
+}
+
+// UpdateTransactionState records a transaction's attempt count, next attempt
+// time, last error and state (pending, or dead_letter) as given by the
+// caller.
+func (d *Database) UpdateTransactionState(
+	ctx context.Context, appserviceID string, txnID, attemptCount int,
+	nextAttemptAt time.Time, lastError string, status types.TransactionStatus,
+) error {
+	_, err := d.transactions.updateTransactionStateStmt.ExecContext(
+		ctx, attemptCount, nextAttemptAt.Unix(), lastError, string(status), appserviceID, txnID,
+	)
+	return err
+}
+
+// DeleteQueuedTransaction removes a transaction from the queue once it has
+// been delivered successfully, or an operator has chosen to drop it.
+func (d *Database) DeleteQueuedTransaction(
+	ctx context.Context, appserviceID string, txnID int,
+) error {
+	_, err := d.transactions.deleteTransactionStmt.ExecContext(ctx, appserviceID, txnID)
+	return err
+}
+
+// RequeueDeadLetteredTransaction moves a dead-lettered transaction back to
+// the pending state, with its attempt count reset and next_attempt_at set to
+// now. It only updates the database: the worker reads pending transactions
+// when it starts, and DeliveryPool.Requeue hands the transaction to a
+// running worker straight away.
+func (d *Database) RequeueDeadLetteredTransaction(
+	ctx context.Context, appserviceID string, txnID int,
+) error {
+	return d.UpdateTransactionState(ctx, appserviceID, txnID, 0, time.Now(), "", types.TransactionStatusPending)
+}
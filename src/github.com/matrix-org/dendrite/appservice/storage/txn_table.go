@@ -0,0 +1,76 @@
+// Copyright 2018 Vector Creations Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"context"
+	"database/sql"
+)
+
+const txnSchema = `
+CREATE TABLE IF NOT EXISTS appservice_txn_id (
+	as_id TEXT PRIMARY KEY,
+	txn_id BIGINT NOT NULL
+);
+`
+
+const selectTxnIDWithAppServiceIDSQL = "" +
+	"SELECT txn_id FROM appservice_txn_id WHERE as_id = $1"
+
+const upsertTxnIDWithAppServiceIDSQL = "" +
+	"INSERT INTO appservice_txn_id (as_id, txn_id) VALUES ($1, $2)" +
+	" ON CONFLICT (as_id) DO UPDATE SET txn_id = $2"
+
+type txnStatements struct {
+	db                              *sql.DB
+	selectTxnIDWithAppServiceIDStmt *sql.Stmt
+	upsertTxnIDWithAppServiceIDStmt *sql.Stmt
+}
+
+func (s *txnStatements) prepare(db *sql.DB) (err error) {
+	s.db = db
+
+	if _, err = db.Exec(txnSchema); err != nil {
+		return err
+	}
+
+	if s.selectTxnIDWithAppServiceIDStmt, err = db.Prepare(selectTxnIDWithAppServiceIDSQL); err != nil {
+		return err
+	}
+	if s.upsertTxnIDWithAppServiceIDStmt, err = db.Prepare(upsertTxnIDWithAppServiceIDSQL); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// GetTxnIDWithAppServiceID returns the next transaction ID to assign to the
+// given application service. Returns sql.ErrNoRows if none has been
+// recorded yet.
+func (d *Database) GetTxnIDWithAppServiceID(
+	ctx context.Context, appserviceID string,
+) (txnID int, err error) {
+	err = d.txn.selectTxnIDWithAppServiceIDStmt.QueryRowContext(ctx, appserviceID).Scan(&txnID)
+	return
+}
+
+// UpsertTxnIDWithAppServiceID records the next transaction ID to assign to
+// the given application service.
+func (d *Database) UpsertTxnIDWithAppServiceID(
+	ctx context.Context, appserviceID string, txnID int,
+) error {
+	_, err := d.txn.upsertTxnIDWithAppServiceIDStmt.ExecContext(ctx, appserviceID, txnID)
+	return err
+}
@@ -0,0 +1,147 @@
+// Copyright 2018 Vector Creations Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package types
+
+import (
+	"sync"
+	"time"
+
+	"github.com/matrix-org/dendrite/common/config"
+)
+
+// TransactionStatus represents the lifecycle of a single queued application
+// service transaction as persisted in the database.
+type TransactionStatus string
+
+const (
+	// TransactionStatusPending means the transaction is still waiting to be
+	// sent, or is due for a retry.
+	TransactionStatusPending TransactionStatus = "pending"
+	// TransactionStatusDeadLetter means the transaction has exceeded its
+	// maximum number of delivery attempts, or was rejected with 401/403, and
+	// requires operator intervention.
+	TransactionStatusDeadLetter TransactionStatus = "dead_letter"
+)
+
+// MaxTransactionAttempts is the number of failed delivery attempts a
+// transaction is allowed before it is moved to the dead_letter state instead
+// of being retried again.
+const MaxTransactionAttempts = 10
+
+// ApplicationServiceWorkerState is a type that couples the Application
+// Service being sent events with a mutex, for use with the sync.Cond used
+// for waking up the worker for that application service.
+type ApplicationServiceWorkerState struct {
+	AppService  config.ApplicationService
+	Cond        *sync.Cond
+	EventsReady *int
+	Backoff     int
+
+	// Outstanding is the number of transactions this AS has handed to the
+	// delivery pool that have not yet reached a terminal state (delivered,
+	// or dead-lettered). It is guarded by Cond.L, the same lock that guards
+	// EventsReady. The producer will not batch a new transaction while this
+	// is non-zero, so a slow or retrying delivery can't make it re-read and
+	// re-enqueue the same undelivered events on every attempt.
+	Outstanding int
+
+	// TxnIDMu guards TxnID, which is read and advanced by both this AS's
+	// producer goroutine (batching transactions) and the delivery pool's
+	// consumer goroutine (on successful delivery).
+	TxnIDMu sync.Mutex
+	// TxnID is the next transaction ID to assign to this application
+	// service. It is per-AS state; sharing a single counter across every
+	// AS's goroutines would let two unrelated application services collide
+	// on the same txn_id.
+	TxnID int
+}
+
+// NewWorkerStateFromAppservice takes in a ApplicationService and returns a
+// new ApplicationServiceWorkerState for this service.
+func NewWorkerStateFromAppservice(as config.ApplicationService) ApplicationServiceWorkerState {
+	eventsReady := 0
+	return ApplicationServiceWorkerState{
+		AppService:  as,
+		Cond:        sync.NewCond(&sync.Mutex{}),
+		EventsReady: &eventsReady,
+	}
+}
+
+// WaitForNewEvents blocks the goroutine until new events are ready to send
+// and no previously handed-off transaction is still outstanding.
+func (ws *ApplicationServiceWorkerState) WaitForNewEvents() {
+	ws.Cond.L.Lock()
+	for *ws.EventsReady == 0 || ws.Outstanding > 0 {
+		ws.Cond.Wait()
+	}
+	ws.Cond.L.Unlock()
+}
+
+// NotifyNewEvents signals that new events have been added for this app
+// service, waking up the worker if it was asleep.
+func (ws *ApplicationServiceWorkerState) NotifyNewEvents() {
+	ws.Cond.L.Lock()
+	*ws.EventsReady++
+	ws.Cond.L.Unlock()
+	ws.Cond.Signal()
+}
+
+// MarkTransactionOutstanding records that a transaction has been handed to
+// the delivery pool and is awaiting a terminal outcome. Called whenever a
+// transaction is enqueued, whether freshly batched, resumed on startup, or
+// requeued from dead_letter by an operator.
+func (ws *ApplicationServiceWorkerState) MarkTransactionOutstanding() {
+	ws.Cond.L.Lock()
+	ws.Outstanding++
+	ws.Cond.L.Unlock()
+}
+
+// MarkTransactionFinished records that a previously-outstanding transaction
+// reached a terminal outcome (delivered, or dead-lettered), waking the
+// producer if it was waiting to batch its next transaction.
+func (ws *ApplicationServiceWorkerState) MarkTransactionFinished() {
+	ws.Cond.L.Lock()
+	ws.Outstanding--
+	ws.Cond.L.Unlock()
+	ws.Cond.Signal()
+}
+
+// QueuedTransaction is a single persisted application service transaction,
+// along with the retry/delivery bookkeeping needed to resume sending it
+// across worker restarts.
+type QueuedTransaction struct {
+	AppServiceID string
+	TxnID        int
+	Payload      []byte
+
+	// MaxEventID, EphemeralMaxID and ToDeviceMaxID are the highest row IDs
+	// in appservice_events, appservice_ephemeral_events and
+	// appservice_to_device_messages respectively that this transaction's
+	// payload was built from, and EventsCount is how many events it
+	// carries. They are persisted alongside the payload so that a
+	// transaction resumed after a restart, or requeued from dead_letter by
+	// an operator, still knows exactly which rows to remove on success and
+	// which to quarantine on dead-lettering, instead of defaulting to zero
+	// and leaving those rows behind to be re-read into the next batch.
+	MaxEventID     int
+	EphemeralMaxID int
+	ToDeviceMaxID  int
+	EventsCount    int
+
+	AttemptCount  int
+	NextAttemptAt time.Time
+	LastError     string
+	Status        TransactionStatus
+}
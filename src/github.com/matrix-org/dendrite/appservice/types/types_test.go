@@ -0,0 +1,84 @@
+// Copyright 2018 Vector Creations Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package types
+
+import (
+	"testing"
+	"time"
+
+	"github.com/matrix-org/dendrite/common/config"
+)
+
+// TestWaitForNewEventsBlocksWhileOutstanding guards against the producer
+// busy-looping on a slow or retrying delivery: WaitForNewEvents must keep
+// blocking while a transaction is still outstanding, even though events are
+// ready, and only return once MarkTransactionFinished reports a terminal
+// outcome.
+func TestWaitForNewEventsBlocksWhileOutstanding(t *testing.T) {
+	ws := NewWorkerStateFromAppservice(config.ApplicationService{ID: "as1"})
+	ws.NotifyNewEvents()
+	ws.MarkTransactionOutstanding()
+
+	done := make(chan struct{})
+	go func() {
+		ws.WaitForNewEvents()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		t.Fatal("WaitForNewEvents returned while a transaction was still outstanding")
+	case <-time.After(50 * time.Millisecond):
+		// Expected: still blocked.
+	}
+
+	ws.MarkTransactionFinished()
+
+	select {
+	case <-done:
+		// Expected: unblocked once the outstanding transaction finished.
+	case <-time.After(time.Second):
+		t.Fatal("WaitForNewEvents did not return after MarkTransactionFinished")
+	}
+}
+
+// TestWaitForNewEventsWaitsForEvents checks the existing half of the
+// condition still holds: with no outstanding transaction, WaitForNewEvents
+// still blocks until events are ready.
+func TestWaitForNewEventsWaitsForEvents(t *testing.T) {
+	ws := NewWorkerStateFromAppservice(config.ApplicationService{ID: "as1"})
+
+	done := make(chan struct{})
+	go func() {
+		ws.WaitForNewEvents()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		t.Fatal("WaitForNewEvents returned before any events were ready")
+	case <-time.After(50 * time.Millisecond):
+		// Expected: still blocked.
+	}
+
+	ws.NotifyNewEvents()
+
+	select {
+	case <-done:
+		// Expected: unblocked once events are ready.
+	case <-time.After(time.Second):
+		t.Fatal("WaitForNewEvents did not return after NotifyNewEvents")
+	}
+}
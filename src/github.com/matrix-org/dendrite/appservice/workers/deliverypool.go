@@ -0,0 +1,399 @@
+// Copyright 2018 Vector Creations Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package workers
+
+import (
+	"context"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/matrix-org/dendrite/appservice/storage"
+	"github.com/matrix-org/dendrite/appservice/types"
+	"github.com/matrix-org/dendrite/common/config"
+	log "github.com/sirupsen/logrus"
+)
+
+// deliveryTask is a single application service transaction waiting to be
+// sent, along with everything needed to finish the job (update the queue,
+// mark events as sent, back off) once it has been.
+type deliveryTask struct {
+	WorkerState    *types.ApplicationServiceWorkerState
+	TxnID          int
+	MaxEventID     int
+	EphemeralMaxID int
+	ToDeviceMaxID  int
+	EventsCount    int
+	Payload        []byte
+	// Attempt is the number of times delivery of this exact transaction has
+	// failed so far. It is persisted as attempt_count and is what decides
+	// dead-lettering; it is independent of WorkerState.Backoff, which only
+	// controls how long to wait before the next retry.
+	Attempt int
+}
+
+// asQueue is the serialized, per-application-service backlog of delivery
+// tasks. Only one goroutine drains a given asQueue at a time, which keeps
+// delivery to that AS in order without holding up delivery to any other AS.
+type asQueue struct {
+	mu      sync.Mutex
+	tasks   []*deliveryTask
+	running bool
+}
+
+// DeliveryPool is a bounded pool of sender goroutines that deliver AS
+// transactions. Each application service gets its own FIFO queue so that a
+// slow or broken AS can never starve the others; the pool as a whole never
+// runs more than numWorkers deliveries concurrently.
+type DeliveryPool struct {
+	db            *storage.Database
+	httpTransport Transport
+	broker        BrokerPublisher
+	sem           chan struct{}
+	mu            sync.Mutex
+	queues        map[string]*asQueue
+	transports    map[string]Transport
+	workerStates  map[string]*types.ApplicationServiceWorkerState
+}
+
+// NewDeliveryPool creates a DeliveryPool that delivers at most numWorkers
+// transactions concurrently over HTTP(S) by default. Call
+// SetBrokerPublisher to additionally enable the "broker" transport for ASes
+// configured with Transport: "broker".
+func NewDeliveryPool(db *storage.Database, numWorkers int) *DeliveryPool {
+	if numWorkers < 1 {
+		numWorkers = 1
+	}
+	return &DeliveryPool{
+		db:            db,
+		httpTransport: newHTTPTransport(nil),
+		sem:           make(chan struct{}, numWorkers),
+		queues:        make(map[string]*asQueue),
+		transports:    make(map[string]Transport),
+		workerStates:  make(map[string]*types.ApplicationServiceWorkerState),
+	}
+}
+
+// SetBrokerPublisher wires a message broker publisher into the pool,
+// enabling the "broker" transport for any application service configured
+// to use it.
+func (p *DeliveryPool) SetBrokerPublisher(broker BrokerPublisher) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.broker = broker
+}
+
+// RegisterWorkerState associates a running application service's worker
+// state with the pool, so that Requeue can hand a dead-lettered
+// transaction back to the live producer's in-memory state (outstanding
+// count, backoff) instead of only updating the database.
+func (p *DeliveryPool) RegisterWorkerState(asID string, ws *types.ApplicationServiceWorkerState) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.workerStates[asID] = ws
+}
+
+// Requeue moves a dead-lettered transaction back to pending in the database
+// and, if the application service's worker is registered with this pool,
+// immediately hands it to the live delivery pool instead of leaving it
+// inert until the worker's next restart-time resume.
+func (p *DeliveryPool) Requeue(ctx context.Context, asID string, txnID int) error {
+	if err := p.db.RequeueDeadLetteredTransaction(ctx, asID, txnID); err != nil {
+		return err
+	}
+
+	p.mu.Lock()
+	ws, ok := p.workerStates[asID]
+	p.mu.Unlock()
+	if !ok {
+		return nil
+	}
+
+	txn, err := p.db.GetQueuedTransaction(ctx, asID, txnID)
+	if err != nil {
+		return err
+	}
+
+	ws.MarkTransactionOutstanding()
+	p.Enqueue(asID, &deliveryTask{
+		WorkerState:    ws,
+		TxnID:          txn.TxnID,
+		Payload:        txn.Payload,
+		MaxEventID:     txn.MaxEventID,
+		EphemeralMaxID: txn.EphemeralMaxID,
+		ToDeviceMaxID:  txn.ToDeviceMaxID,
+		EventsCount:    txn.EventsCount,
+		Attempt:        txn.AttemptCount,
+	})
+	return nil
+}
+
+// transportFor returns the cached Transport for an application service,
+// selecting (and caching) one based on its config the first time it's
+// delivered to.
+func (p *DeliveryPool) transportFor(as config.ApplicationService) Transport {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if t, ok := p.transports[as.ID]; ok {
+		return t
+	}
+	t := transportForAppService(as, p.httpTransport, p.broker)
+	p.transports[as.ID] = t
+	return t
+}
+
+// Enqueue adds a delivery task to the back of its application service's
+// queue, starting a drain goroutine for that AS if one isn't already
+// running.
+func (p *DeliveryPool) Enqueue(asID string, task *deliveryTask) {
+	q := p.queueFor(asID)
+
+	q.mu.Lock()
+	q.tasks = append(q.tasks, task)
+	depth := len(q.tasks)
+	shouldStart := !q.running
+	if shouldStart {
+		q.running = true
+	}
+	q.mu.Unlock()
+
+	queueDepth.WithLabelValues(asID).Set(float64(depth))
+
+	if shouldStart {
+		go p.drain(asID, q)
+	}
+}
+
+// DeleteQueueForAppService drops every queued task for an application
+// service, without sending them. Used when an AS is removed from the
+// config.
+func (p *DeliveryPool) DeleteQueueForAppService(asID string) {
+	p.mu.Lock()
+	q, ok := p.queues[asID]
+	delete(p.transports, asID)
+	p.mu.Unlock()
+	if !ok {
+		return
+	}
+
+	q.mu.Lock()
+	q.tasks = nil
+	q.mu.Unlock()
+}
+
+// DeleteQueuedTask removes a single not-yet-dispatched delivery task from an
+// application service's queue, identified by the transaction ID it was
+// enqueued under. Used when the event(s) a queued transaction was built from
+// have been superseded and should no longer be sent once delivery catches up
+// to them; unlike DeleteQueueForAppService this drops one transaction rather
+// than the whole queue, so delivery of everything else queued for the AS is
+// unaffected. Returns true if a matching, still-queued task was found and
+// removed; false if it had already been dispatched (or didn't exist).
+func (p *DeliveryPool) DeleteQueuedTask(asID string, txnID int) bool {
+	p.mu.Lock()
+	q, ok := p.queues[asID]
+	p.mu.Unlock()
+	if !ok {
+		return false
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for i, t := range q.tasks {
+		if t.TxnID == txnID {
+			q.tasks = append(q.tasks[:i], q.tasks[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+func (p *DeliveryPool) queueFor(asID string) *asQueue {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	q, ok := p.queues[asID]
+	if !ok {
+		q = &asQueue{}
+		p.queues[asID] = q
+	}
+	return q
+}
+
+// drain pulls tasks off an AS's queue one at a time, occupying a single
+// pool worker slot for the duration of each delivery. It exits once the
+// queue is empty, and is restarted by Enqueue the next time work arrives.
+func (p *DeliveryPool) drain(asID string, q *asQueue) {
+	for {
+		q.mu.Lock()
+		if len(q.tasks) == 0 {
+			q.running = false
+			q.mu.Unlock()
+			return
+		}
+		task := q.tasks[0]
+		q.tasks = q.tasks[1:]
+		depth := len(q.tasks)
+		q.mu.Unlock()
+
+		queueDepth.WithLabelValues(asID).Set(float64(depth))
+
+		p.sem <- struct{}{}
+		p.process(asID, task)
+		<-p.sem
+	}
+}
+
+// process delivers a single task. On success it removes the queue row and
+// the rows the transaction was built from, and advances the AS's
+// transaction ID. On failure it
+// persists the new backoff state and schedules a requeue with a timer
+// instead of sleeping, so the worker goroutine is immediately free to
+// deliver to another application service.
+func (p *DeliveryPool) process(asID string, task *deliveryTask) {
+	ctx := context.Background()
+	ws := task.WorkerState
+
+	start := time.Now()
+	err := p.transportFor(ws.AppService).Send(ctx, ws.AppService, task.TxnID, task.Payload)
+	duration := time.Since(start).Seconds()
+
+	if err == nil {
+		transactionSendDuration.WithLabelValues(asID, "ok").Observe(duration)
+		transactionsSentTotal.WithLabelValues(asID).Inc()
+		backoffSeconds.WithLabelValues(asID).Set(0)
+
+		ws.Backoff = 0
+
+		if derr := p.db.DeleteQueuedTransaction(ctx, asID, task.TxnID); derr != nil {
+			log.WithFields(log.Fields{"appservice": asID}).WithError(derr).
+				Error("unable to remove delivered transaction from the queue")
+		}
+
+		p.quarantineTaskRows(ctx, asID, task)
+
+		// A requeued older transaction must not move the counter backwards.
+		ws.TxnIDMu.Lock()
+		if task.TxnID+1 > ws.TxnID {
+			ws.TxnID = task.TxnID + 1
+		}
+		nextTxnID := ws.TxnID
+		ws.TxnIDMu.Unlock()
+		if derr := p.db.UpsertTxnIDWithAppServiceID(ctx, asID, nextTxnID); derr != nil {
+			log.WithFields(log.Fields{"appservice": asID}).WithError(derr).
+				Error("unable to update transaction ID")
+		}
+
+		ws.MarkTransactionFinished()
+		return
+	}
+
+	transactionSendDuration.WithLabelValues(asID, "failed").Observe(duration)
+	task.Attempt++
+
+	// A permanent auth failure (401/403) will never succeed on retry: the
+	// hs_token is wrong, so dead-letter immediately without burning through
+	// the backoff schedule.
+	if sendErr, ok := err.(*sendError); ok && sendErr.permanent {
+		transactionsFailedTotal.WithLabelValues(asID, "auth").Inc()
+		if uerr := p.db.UpdateTransactionState(ctx, asID, task.TxnID, task.Attempt, time.Now(), err.Error(), types.TransactionStatusDeadLetter); uerr != nil {
+			log.WithFields(log.Fields{"appservice": asID}).WithError(uerr).
+				Error("unable to persist transaction backoff state")
+		}
+		p.quarantineTaskRows(ctx, asID, task)
+		ws.MarkTransactionFinished()
+		log.WithFields(log.Fields{"appservice": asID, "txn_id": task.TxnID}).WithError(err).
+			Error("appservice rejected hs_token, moved transaction to dead_letter")
+		return
+	}
+
+	// ws.Backoff is the shared exponent used purely to compute how long to
+	// wait before the next retry; it is capped at 6 (~64s) so a wedged AS
+	// doesn't push out retries indefinitely. task.Attempt is the unbounded,
+	// per-transaction count of failed deliveries, persisted as
+	// attempt_count, and is what actually decides dead-lettering.
+	ws.Backoff++
+	if ws.Backoff > 6 {
+		ws.Backoff = 6
+	}
+	backoffDuration := time.Duration(math.Pow(2, float64(ws.Backoff))) * time.Second
+	if sendErr, ok := err.(*sendError); ok && sendErr.retryAfter > 0 {
+		backoffDuration = sendErr.retryAfter
+	}
+	nextAttemptAt := time.Now().Add(backoffDuration)
+	backoffSeconds.WithLabelValues(asID).Set(backoffDuration.Seconds())
+
+	status := types.TransactionStatusPending
+	reason := "http_error"
+	if task.Attempt >= types.MaxTransactionAttempts {
+		status = types.TransactionStatusDeadLetter
+		reason = "max_attempts"
+	}
+	transactionsFailedTotal.WithLabelValues(asID, reason).Inc()
+
+	if uerr := p.db.UpdateTransactionState(ctx, asID, task.TxnID, task.Attempt, nextAttemptAt, err.Error(), status); uerr != nil {
+		log.WithFields(log.Fields{"appservice": asID}).WithError(uerr).
+			Error("unable to persist transaction backoff state")
+	}
+
+	if status == types.TransactionStatusDeadLetter {
+		p.quarantineTaskRows(ctx, asID, task)
+		ws.MarkTransactionFinished()
+		log.WithFields(log.Fields{"appservice": asID, "txn_id": task.TxnID}).WithError(err).
+			Error("transaction exceeded max attempts, moved to dead_letter")
+		return
+	}
+
+	log.WithFields(log.Fields{"appservice": asID}).WithError(err).
+		Warnf("unable to send transaction, retrying in %s", backoffDuration)
+
+	time.AfterFunc(backoffDuration, func() {
+		p.Enqueue(asID, task)
+	})
+}
+
+// quarantineTaskRows removes the appservice_events/ephemeral/to-device rows
+// a task's payload was built from, and adjusts EventsReady to match. It is
+// called once a task reaches either terminal outcome: delivered, or
+// dead-lettered. Without this on the dead-letter path too, those rows stay
+// queryable with their original txn_id, so the next time the producer loops
+// round it would read the same rows, rebuild the same txn_id, and the
+// ON CONFLICT upsert in UpsertQueuedTransaction would silently resurrect the
+// dead-lettered transaction back to pending.
+func (p *DeliveryPool) quarantineTaskRows(ctx context.Context, asID string, task *deliveryTask) {
+	ws := task.WorkerState
+
+	ws.Cond.L.Lock()
+	*ws.EventsReady -= task.EventsCount
+	ws.Cond.L.Unlock()
+
+	if derr := p.db.RemoveEventsBeforeAndIncludingID(ctx, asID, task.MaxEventID); derr != nil {
+		log.WithFields(log.Fields{"appservice": asID}).WithError(derr).
+			Error("unable to remove appservice events from the database")
+	}
+	if task.EphemeralMaxID > 0 {
+		if derr := p.db.RemoveEphemeralEventsBeforeAndIncludingID(ctx, asID, task.EphemeralMaxID); derr != nil {
+			log.WithFields(log.Fields{"appservice": asID}).WithError(derr).
+				Error("unable to remove appservice ephemeral events from the database")
+		}
+	}
+	if task.ToDeviceMaxID > 0 {
+		if derr := p.db.RemoveToDeviceMessagesBeforeAndIncludingID(ctx, asID, task.ToDeviceMaxID); derr != nil {
+			log.WithFields(log.Fields{"appservice": asID}).WithError(derr).
+				Error("unable to remove appservice to-device messages from the database")
+		}
+	}
+}
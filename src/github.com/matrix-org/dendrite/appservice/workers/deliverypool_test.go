@@ -0,0 +1,53 @@
+// Copyright 2018 Vector Creations Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package workers
+
+import "testing"
+
+// TestDeleteQueuedTaskRemovesOnlyMatchingTransaction checks that
+// DeleteQueuedTask drops the task for the given txn_id without disturbing
+// the rest of the AS's queue, so dropping a superseded transaction can't
+// also silently drop whatever's queued behind it.
+func TestDeleteQueuedTaskRemovesOnlyMatchingTransaction(t *testing.T) {
+	p := NewDeliveryPool(nil, 1)
+	q := p.queueFor("as1")
+	q.tasks = []*deliveryTask{{TxnID: 1}, {TxnID: 2}, {TxnID: 3}}
+
+	if !p.DeleteQueuedTask("as1", 2) {
+		t.Fatal("DeleteQueuedTask returned false for a queued txn_id")
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if len(q.tasks) != 2 || q.tasks[0].TxnID != 1 || q.tasks[1].TxnID != 3 {
+		t.Fatalf("unexpected queue contents after delete: %+v", q.tasks)
+	}
+}
+
+// TestDeleteQueuedTaskMissingReturnsFalse checks the not-found cases:
+// an unknown application service, and a txn_id that was never queued (or
+// has already been dispatched).
+func TestDeleteQueuedTaskMissingReturnsFalse(t *testing.T) {
+	p := NewDeliveryPool(nil, 1)
+
+	if p.DeleteQueuedTask("unknown-as", 1) {
+		t.Fatal("DeleteQueuedTask returned true for an application service with no queue")
+	}
+
+	p.queueFor("as1")
+	if p.DeleteQueuedTask("as1", 42) {
+		t.Fatal("DeleteQueuedTask returned true for a txn_id that was never queued")
+	}
+}
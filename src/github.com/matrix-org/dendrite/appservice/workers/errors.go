@@ -0,0 +1,35 @@
+// Copyright 2018 Vector Creations Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package workers
+
+import "time"
+
+// sendError is returned by send when an application service responds with a
+// non-2xx status, and carries enough information for the delivery pool to
+// decide whether the transaction is worth retrying.
+type sendError struct {
+	err error
+	// permanent is true for 401/403 responses: the hs_token is wrong and
+	// retrying with the same credentials will never succeed, so the
+	// transaction should be dead-lettered immediately instead of backed off.
+	permanent bool
+	// retryAfter is set when the AS returned 429 with a Retry-After header,
+	// and should be honoured instead of the usual exponential backoff.
+	retryAfter time.Duration
+}
+
+func (e *sendError) Error() string { return e.err.Error() }
+
+func (e *sendError) Unwrap() error { return e.err }
@@ -0,0 +1,82 @@
+// Copyright 2018 Vector Creations Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package workers
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	transactionSendDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: "dendrite",
+			Subsystem: "appservice",
+			Name:      "transaction_send_duration_seconds",
+			Help:      "Time taken to deliver a single transaction to an application service.",
+			Buckets:   []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60},
+		},
+		[]string{"as_id", "status"},
+	)
+
+	transactionsSentTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "dendrite",
+			Subsystem: "appservice",
+			Name:      "transactions_sent_total",
+			Help:      "Total number of transactions successfully delivered to an application service.",
+		},
+		[]string{"as_id"},
+	)
+
+	transactionsFailedTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "dendrite",
+			Subsystem: "appservice",
+			Name:      "transactions_failed_total",
+			Help:      "Total number of transaction delivery attempts that failed, by reason.",
+		},
+		[]string{"as_id", "reason"},
+	)
+
+	queueDepth = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "dendrite",
+			Subsystem: "appservice",
+			Name:      "queue_depth",
+			Help:      "Number of transactions currently queued for an application service.",
+		},
+		[]string{"as_id"},
+	)
+
+	backoffSeconds = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "dendrite",
+			Subsystem: "appservice",
+			Name:      "backoff_seconds",
+			Help:      "Current backoff duration, in seconds, for an application service's next retry.",
+		},
+		[]string{"as_id"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(
+		transactionSendDuration,
+		transactionsSentTotal,
+		transactionsFailedTotal,
+		queueDepth,
+		backoffSeconds,
+	)
+}
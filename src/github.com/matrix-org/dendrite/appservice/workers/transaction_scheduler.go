@@ -20,14 +20,15 @@ import (
 	"database/sql"
 	"encoding/json"
 	"fmt"
-	"math"
 	"net/http"
+	"strconv"
 	"time"
 
 	"github.com/matrix-org/dendrite/appservice/storage"
 	"github.com/matrix-org/dendrite/appservice/types"
 	"github.com/matrix-org/dendrite/common/config"
 	"github.com/matrix-org/gomatrixserverlib"
+	opentracing "github.com/opentracing/opentracing-go"
 	log "github.com/sirupsen/logrus"
 )
 
@@ -40,40 +41,54 @@ var (
 	transactionBatchSize = 50
 	// Timeout for sending a single transaction to an application service.
 	transactionTimeout = time.Second * 60
-	// The current transaction ID. Increments after every successful transaction.
-	currentTransactionID = 0
 )
 
-// SetupTransactionWorkers spawns a separate goroutine for each application
-// service. Each of these "workers" handle taking all events intended for their
-// app service, batch them up into a single transaction (up to a max transaction
-// size), then send that off to the AS's /transactions/{txnID} endpoint. It also
-// handles exponentially backing off in case the AS isn't currently available.
+// SetupTransactionWorkers creates a bounded DeliveryPool and spawns a
+// producer goroutine for each application service. Each producer batches
+// events intended for its app service into transactions and hands them to
+// the pool for delivery; the pool serializes delivery per-AS but spreads
+// delivery across cfg.DeliveryWorkerCount() goroutines, so a slow or
+// broken AS can no longer starve the others.
 func SetupTransactionWorkers(
 	appserviceDB *storage.Database,
 	workerStates []types.ApplicationServiceWorkerState,
-) error {
-	// Create a worker that handles transmitting events to a single homeserver
-	for _, workerState := range workerStates {
+	cfg config.AppServiceConfig,
+) (*DeliveryPool, error) {
+	pool := NewDeliveryPool(appserviceDB, cfg.DeliveryWorkerCount())
+
+	// Create a producer that handles batching events for a single AS
+	for i := range workerStates {
+		ws := &workerStates[i]
 		// Don't create a worker if this AS doesn't want to receive events
-		if workerState.AppService.URL != "" {
-			go worker(appserviceDB, workerState)
+		if ws.AppService.URL == "" {
+			continue
 		}
+		// Register the worker state by pointer so the admin API's requeue
+		// handler can hand a dead-lettered transaction straight back to the
+		// same state this AS's producer is mutating, not a stale copy.
+		pool.RegisterWorkerState(ws.AppService.ID, ws)
+		go worker(appserviceDB, ws, pool)
 	}
-	return nil
+	return pool, nil
 }
 
-// worker is a goroutine that sends any queued events to the application service
-// it is given.
-func worker(db *storage.Database, ws types.ApplicationServiceWorkerState) {
+// worker is a goroutine that batches any queued events for the application
+// service it is given into transactions and hands them off to the delivery
+// pool. Actual delivery, retries and dead-lettering are handled by the pool;
+// this goroutine only waits, in WaitForNewEvents, until every transaction it
+// handed off has been delivered or dead-lettered before batching the next.
+func worker(db *storage.Database, ws *types.ApplicationServiceWorkerState, pool *DeliveryPool) {
 	log.WithFields(log.Fields{
 		"appservice": ws.AppService.ID,
 	}).Info("starting application service")
 	ctx := context.Background()
 
-	// Initialize transaction ID counter
-	var err error
-	currentTransactionID, err = db.GetTxnIDWithAppServiceID(ctx, ws.AppService.ID)
+	// Initialize this AS's transaction ID counter. It is kept on the
+	// worker state, not a package-level global, so that concurrent
+	// goroutines for different application services can never collide on
+	// the same txn_id.
+	initialTxnID, err := db.GetTxnIDWithAppServiceID(ctx, ws.AppService.ID)
+	ws.TxnID = initialTxnID
 	if err != nil && err != sql.ErrNoRows {
 		log.WithFields(log.Fields{
 			"appservice": ws.AppService.ID,
@@ -81,9 +96,13 @@ func worker(db *storage.Database, ws types.ApplicationServiceWorkerState) {
 		return
 	}
 
-	// Grab the HTTP client for sending requests to app services
-	client := &http.Client{
-		Timeout: transactionTimeout,
+	// Resume any transactions that were queued (and possibly partially sent)
+	// before the worker last stopped, honoring their recorded next_attempt_at
+	// so a restart doesn't reset their backoff.
+	if err = resumeQueuedTransactions(ctx, db, ws, pool); err != nil {
+		log.WithFields(log.Fields{
+			"appservice": ws.AppService.ID,
+		}).WithError(err).Error("appservice worker unable to resume queued transactions")
 	}
 
 	// Initial check for any leftover events to send from last time
@@ -104,7 +123,8 @@ func worker(db *storage.Database, ws types.ApplicationServiceWorkerState) {
 		ws.WaitForNewEvents()
 
 		// Batch events up into a transaction
-		eventsCount, txnID, maxEventID, transactionJSON, err := createTransaction(ctx, db, ws.AppService.ID)
+		eventsCount, txnID, maxEventID, ephemeralMaxID, toDeviceMaxID, transactionJSON, err :=
+			createTransaction(ctx, db, ws)
 		if err != nil {
 			log.WithFields(log.Fields{
 				"appservice": ws.AppService.ID,
@@ -113,60 +133,87 @@ func worker(db *storage.Database, ws types.ApplicationServiceWorkerState) {
 			return
 		}
 
-		// Send the events off to the application service
-		// Backoff if the application service does not respond
-		err = send(client, ws.AppService, txnID, transactionJSON)
-		if err != nil {
-			// Backoff
-			backoff(&ws, err)
-			continue
-		}
-
-		// We sent successfully, hooray!
-		ws.Backoff = 0
-
-		ws.Cond.L.Lock()
-		*ws.EventsReady -= eventsCount
-		ws.Cond.L.Unlock()
-
-		// Remove sent events from the DB
-		err = db.RemoveEventsBeforeAndIncludingID(ctx, ws.AppService.ID, maxEventID)
-		if err != nil {
+		// Persist the transaction as a first-class queue row before we
+		// hand it to the pool, so a crash mid-delivery can be resumed.
+		if err = db.UpsertQueuedTransaction(ctx, ws.AppService.ID, types.QueuedTransaction{
+			TxnID:          txnID,
+			Payload:        transactionJSON,
+			MaxEventID:     maxEventID,
+			EphemeralMaxID: ephemeralMaxID,
+			ToDeviceMaxID:  toDeviceMaxID,
+			EventsCount:    eventsCount,
+			NextAttemptAt:  time.Now(),
+			Status:         types.TransactionStatusPending,
+		}); err != nil {
 			log.WithFields(log.Fields{
 				"appservice": ws.AppService.ID,
-			}).WithError(err).Fatal("unable to remove appservice events from the database")
-			return
+			}).WithError(err).Error("appservice worker unable to persist queued transaction")
 		}
 
-		// Update transactionID
-		currentTransactionID++
-		if err = db.UpsertTxnIDWithAppServiceID(ctx, ws.AppService.ID, currentTransactionID); err != nil {
-			log.WithFields(log.Fields{
-				"appservice": ws.AppService.ID,
-			}).WithError(err).Fatal("unable to update transaction ID")
-			return
-		}
+		ws.MarkTransactionOutstanding()
+		pool.Enqueue(ws.AppService.ID, &deliveryTask{
+			WorkerState:    ws,
+			TxnID:          txnID,
+			MaxEventID:     maxEventID,
+			EphemeralMaxID: ephemeralMaxID,
+			ToDeviceMaxID:  toDeviceMaxID,
+			EventsCount:    eventsCount,
+			Payload:        transactionJSON,
+		})
+
+		ws.TxnIDMu.Lock()
+		ws.TxnID = txnID + 1
+		ws.TxnIDMu.Unlock()
 	}
 }
 
-// backoff pauses the calling goroutine for a 2^some backoff exponent seconds
-func backoff(ws *types.ApplicationServiceWorkerState, err error) {
-	// Calculate how long to backoff for
-	backoffDuration := time.Duration(math.Pow(2, float64(ws.Backoff)))
-	backoffSeconds := time.Second * backoffDuration
+// resumeQueuedTransactions re-reads every pending (including partially sent)
+// transaction for this application service and hands it back to the
+// delivery pool, which will honour its recorded next_attempt_at.
+func resumeQueuedTransactions(
+	ctx context.Context, db *storage.Database, ws *types.ApplicationServiceWorkerState, pool *DeliveryPool,
+) error {
+	pending, err := db.GetPendingTransactions(ctx, ws.AppService.ID)
+	if err != nil {
+		return err
+	}
 
-	log.WithFields(log.Fields{
-		"appservice": ws.AppService.ID,
-	}).WithError(err).Warnf("unable to send transactions successfully, backing off for %ds",
-		backoffDuration)
+	for _, txn := range pending {
+		task := &deliveryTask{
+			WorkerState:    ws,
+			TxnID:          txn.TxnID,
+			Payload:        txn.Payload,
+			MaxEventID:     txn.MaxEventID,
+			EphemeralMaxID: txn.EphemeralMaxID,
+			ToDeviceMaxID:  txn.ToDeviceMaxID,
+			EventsCount:    txn.EventsCount,
+			Attempt:        txn.AttemptCount,
+		}
 
-	ws.Backoff++
-	if ws.Backoff > 6 {
-		ws.Backoff = 6
+		ws.MarkTransactionOutstanding()
+		if until := time.Until(txn.NextAttemptAt); until > 0 {
+			time.AfterFunc(until, func() { pool.Enqueue(ws.AppService.ID, task) })
+			continue
+		}
+		pool.Enqueue(ws.AppService.ID, task)
 	}
 
-	// Backoff
-	time.Sleep(backoffSeconds)
+	return nil
+}
+
+// transactionPayload is the body of a PUT /transactions/{txnID} request, per
+// the current Matrix AS API. gomatrixserverlib.ApplicationServiceTransaction
+// only carries Events, so we wrap it here to also carry ephemeral data and
+// to-device messages. The ephemeral/to_device queues themselves have a read
+// and an insert side (storage.Database.InsertEphemeralEvent,
+// InsertToDeviceMessage), but wiring a typing/receipts/presence/to-device
+// producer to call the insert side is explicitly out of scope here and
+// tracked as separate follow-up work, so these fields are empty in
+// practice until that lands.
+type transactionPayload struct {
+	Events    []gomatrixserverlib.ApplicationServiceEvent `json:"events"`
+	Ephemeral []json.RawMessage                           `json:"ephemeral,omitempty"`
+	ToDevice  []json.RawMessage                           `json:"to_device,omitempty"`
 }
 
 // createTransaction takes in a slice of AS events, stores them in an AS
@@ -174,12 +221,17 @@ func backoff(ws *types.ApplicationServiceWorkerState, err error) {
 func createTransaction(
 	ctx context.Context,
 	db *storage.Database,
-	appserviceID string,
+	ws *types.ApplicationServiceWorkerState,
 ) (
-	eventsCount, txnID, maxID int,
+	eventsCount, txnID, maxID, ephemeralMaxID, toDeviceMaxID int,
 	transactionJSON []byte,
 	err error,
 ) {
+	appserviceID := ws.AppService.ID
+	span, ctx := opentracing.StartSpanFromContext(ctx, "appservice.createTransaction")
+	span.SetTag("appservice_id", appserviceID)
+	defer span.Finish()
+
 	// Retrieve the latest events from the DB (will return old events if they weren't successfully sent)
 	txnID, maxID, events, err := db.GetEventsWithAppServiceID(ctx, appserviceID, transactionBatchSize)
 	if err != nil {
@@ -192,17 +244,33 @@ func createTransaction(
 
 	// Check if these events already have a transaction ID
 	if txnID == -1 {
-		txnID = currentTransactionID
+		ws.TxnIDMu.Lock()
+		txnID = ws.TxnID
+		ws.TxnIDMu.Unlock()
 		// Mark new events with current transactionID
-		err := db.UpdateTxnIDForEvents(ctx, appserviceID, maxID, currentTransactionID)
+		err := db.UpdateTxnIDForEvents(ctx, appserviceID, maxID, txnID)
 		if err != nil {
-			return 0, 0, 0, nil, err
+			return 0, 0, 0, 0, 0, nil, err
 		}
 	}
 
+	// Pull along any typing/receipt/presence updates and to-device messages
+	// queued for this AS, so they ride along in the same transaction.
+	var ephemeral, toDevice []json.RawMessage
+	ephemeralMaxID, ephemeral, err = db.GetEphemeralEventsWithAppServiceID(ctx, appserviceID, transactionBatchSize)
+	if err != nil {
+		return 0, 0, 0, 0, 0, nil, err
+	}
+	toDeviceMaxID, toDevice, err = db.GetToDeviceMessagesWithAppServiceID(ctx, appserviceID, transactionBatchSize)
+	if err != nil {
+		return 0, 0, 0, 0, 0, nil, err
+	}
+
 	// Create a transaction and store the events inside
-	transaction := gomatrixserverlib.ApplicationServiceTransaction{
-		Events: events,
+	transaction := transactionPayload{
+		Events:    events,
+		Ephemeral: ephemeral,
+		ToDevice:  toDevice,
 	}
 
 	transactionJSON, err = json.Marshal(transaction)
@@ -214,17 +282,33 @@ func createTransaction(
 	return
 }
 
-// send sends events to an application service. Returns an error if an OK was not
-// received back from the application service or the request timed out.
+// send PUTs a transaction to an application service's /transactions/{txnID}
+// endpoint, authenticating with the AS's hs_token per the current Matrix AS
+// API. It classifies the response so callers can tell a permanent auth
+// failure (401/403, don't retry) apart from a transient one (5xx, retry
+// with backoff) and honour 429 Retry-After.
 func send(
+	ctx context.Context,
 	client *http.Client,
 	appservice config.ApplicationService,
 	txnID int,
 	transaction []byte,
 ) error {
-	// POST a transaction to our AS
-	address := fmt.Sprintf("%s/transactions/%d", appservice.URL, txnID)
-	resp, err := client.Post(address, "application/json", bytes.NewBuffer(transaction))
+	span, ctx := opentracing.StartSpanFromContext(ctx, "appservice.send")
+	span.SetTag("appservice_id", appservice.ID)
+	span.SetTag("txn_id", txnID)
+	defer span.Finish()
+
+	address := fmt.Sprintf("%s/transactions/%d?access_token=%s", appservice.URL, txnID, appservice.HSToken)
+	req, err := http.NewRequest(http.MethodPut, address, bytes.NewBuffer(transaction))
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+appservice.HSToken)
+
+	resp, err := client.Do(req)
 	if err != nil {
 		return err
 	}
@@ -237,11 +321,27 @@ func send(
 		}
 	}()
 
-	// Check the AS received the events correctly
-	if resp.StatusCode != http.StatusOK {
-		// TODO: Handle non-200 error codes from application services
-		return fmt.Errorf("non-OK status code %d returned from AS", resp.StatusCode)
-	}
+	switch {
+	case resp.StatusCode == http.StatusOK:
+		return nil
 
-	return nil
+	case resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden:
+		return &sendError{
+			err:       fmt.Errorf("appservice rejected hs_token with status code %d", resp.StatusCode),
+			permanent: true,
+		}
+
+	case resp.StatusCode == http.StatusTooManyRequests:
+		retryAfter := time.Duration(0)
+		if secs, perr := strconv.Atoi(resp.Header.Get("Retry-After")); perr == nil {
+			retryAfter = time.Duration(secs) * time.Second
+		}
+		return &sendError{
+			err:        fmt.Errorf("rate limited by appservice, status code %d", resp.StatusCode),
+			retryAfter: retryAfter,
+		}
+
+	default:
+		return &sendError{err: fmt.Errorf("non-OK status code %d returned from AS", resp.StatusCode)}
+	}
 }
@@ -0,0 +1,48 @@
+// Copyright 2018 Vector Creations Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package workers
+
+import (
+	"context"
+	"strings"
+
+	"github.com/matrix-org/dendrite/common/config"
+)
+
+// Transport delivers a single AS transaction somewhere. Implementations are
+// free to interpret "delivery" however suits the application service: an
+// HTTP request, a write to a Unix socket, or a publish to a message broker.
+type Transport interface {
+	Send(ctx context.Context, as config.ApplicationService, txnID int, payload []byte) error
+}
+
+// transportForAppService picks the Transport to use for a given application
+// service, based on its configured URL scheme and Transport setting:
+//
+//   - a "unix://" URL always uses the Unix domain socket transport
+//   - Transport: "broker" publishes to a message broker instead of making
+//     an HTTP request, if a BrokerPublisher has been set on the delivery
+//     pool; without one it uses the HTTP transport
+//   - anything else falls back to the pooled HTTP/1.1+HTTP/2 transport
+func transportForAppService(as config.ApplicationService, httpTransport Transport, broker BrokerPublisher) Transport {
+	switch {
+	case strings.HasPrefix(as.URL, "unix://"):
+		return newUnixTransport(strings.TrimPrefix(as.URL, "unix://"))
+	case as.Transport == "broker" && broker != nil:
+		return newBrokerTransport(broker)
+	default:
+		return httpTransport
+	}
+}
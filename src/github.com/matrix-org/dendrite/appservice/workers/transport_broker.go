@@ -0,0 +1,92 @@
+// Copyright 2018 Vector Creations Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package workers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/matrix-org/dendrite/common/config"
+	"github.com/nats-io/nats.go"
+)
+
+// BrokerPublisher is the minimal interface the broker transport needs from
+// a message broker client. NATSBrokerPublisher is the only implementation
+// this package ships; a Kafka-backed deployment can satisfy this interface
+// with its own producer wrapper, but no such wrapper is included here.
+type BrokerPublisher interface {
+	Publish(subject string, data []byte) error
+}
+
+// brokerMessage is the payload published to the broker subject. It carries
+// the application service ID and transaction ID alongside the transaction
+// body.
+type brokerMessage struct {
+	AppServiceID string          `json:"as_id"`
+	TxnID        int             `json:"txn_id"`
+	Transaction  json.RawMessage `json:"transaction"`
+}
+
+// brokerTransport delivers transactions by publishing them to a message
+// broker subject instead of making an HTTP request, for high-volume bridges
+// that would rather consume transactions asynchronously off a queue.
+type brokerTransport struct {
+	publisher BrokerPublisher
+}
+
+func newBrokerTransport(publisher BrokerPublisher) *brokerTransport {
+	return &brokerTransport{publisher: publisher}
+}
+
+// Send implements Transport.
+func (t *brokerTransport) Send(ctx context.Context, as config.ApplicationService, txnID int, payload []byte) error {
+	subject := as.BrokerSubject
+	if subject == "" {
+		subject = "appservice." + as.ID
+	}
+
+	data, err := json.Marshal(brokerMessage{
+		AppServiceID: as.ID,
+		TxnID:        txnID,
+		Transaction:  payload,
+	})
+	if err != nil {
+		return err
+	}
+
+	return t.publisher.Publish(subject, data)
+}
+
+// NATSBrokerPublisher publishes transactions to a NATS subject. It is the
+// only BrokerPublisher implementation this package provides.
+type NATSBrokerPublisher struct {
+	conn *nats.Conn
+}
+
+// NewNATSBrokerPublisher connects to the given NATS server for publishing
+// AS transactions.
+func NewNATSBrokerPublisher(natsURL string) (*NATSBrokerPublisher, error) {
+	conn, err := nats.Connect(natsURL)
+	if err != nil {
+		return nil, fmt.Errorf("unable to connect to NATS: %w", err)
+	}
+	return &NATSBrokerPublisher{conn: conn}, nil
+}
+
+// Publish implements BrokerPublisher.
+func (p *NATSBrokerPublisher) Publish(subject string, data []byte) error {
+	return p.conn.Publish(subject, data)
+}
@@ -0,0 +1,62 @@
+// Copyright 2018 Vector Creations Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package workers
+
+import (
+	"context"
+	"crypto/tls"
+	"net/http"
+
+	"github.com/matrix-org/dendrite/common/config"
+	"golang.org/x/net/http2"
+)
+
+// httpTransport delivers transactions over HTTP(S), with a pooled,
+// keep-alive client that transparently speaks HTTP/2 to application
+// services that support it.
+type httpTransport struct {
+	client *http.Client
+}
+
+// newHTTPTransport builds an httpTransport with connection pooling and
+// configurable TLS verification, shared across every HTTP-delivered
+// application service.
+func newHTTPTransport(tlsConfig *tls.Config) *httpTransport {
+	if tlsConfig == nil {
+		tlsConfig = &tls.Config{}
+	}
+
+	roundTripper := &http.Transport{
+		TLSClientConfig:     tlsConfig,
+		MaxIdleConns:        100,
+		MaxIdleConnsPerHost: 10,
+		IdleConnTimeout:     transactionTimeout,
+	}
+	// Enable transparent HTTP/2 over TLS for ASes that support it; falls
+	// back to HTTP/1.1 automatically when they don't.
+	_ = http2.ConfigureTransport(roundTripper)
+
+	return &httpTransport{
+		client: &http.Client{
+			Timeout:   transactionTimeout,
+			Transport: roundTripper,
+		},
+	}
+}
+
+// Send implements Transport.
+func (t *httpTransport) Send(ctx context.Context, as config.ApplicationService, txnID int, payload []byte) error {
+	return send(ctx, t.client, as, txnID, payload)
+}
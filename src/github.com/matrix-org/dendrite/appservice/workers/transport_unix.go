@@ -0,0 +1,57 @@
+// Copyright 2018 Vector Creations Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package workers
+
+import (
+	"context"
+	"net"
+	"net/http"
+
+	"github.com/matrix-org/dendrite/common/config"
+)
+
+// unixTransport delivers transactions over a Unix domain socket instead of
+// TCP, for application services colocated on the same host. The AS is
+// still addressed with a normal http://.../transactions/{txnID} request;
+// only the underlying connection is a Unix socket, dialed at sockPath.
+type unixTransport struct {
+	client *http.Client
+}
+
+// newUnixTransport builds an unixTransport that dials sockPath for every
+// request, ignoring the host and port in the application service's URL.
+func newUnixTransport(sockPath string) *unixTransport {
+	dialer := &net.Dialer{}
+	roundTripper := &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return dialer.DialContext(ctx, "unix", sockPath)
+		},
+	}
+
+	return &unixTransport{
+		client: &http.Client{
+			Timeout:   transactionTimeout,
+			Transport: roundTripper,
+		},
+	}
+}
+
+// Send implements Transport. The application service's URL is rewritten to
+// a dummy HTTP host, since the actual destination is the Unix socket the
+// client dials.
+func (t *unixTransport) Send(ctx context.Context, as config.ApplicationService, txnID int, payload []byte) error {
+	as.URL = "http://unix"
+	return send(ctx, t.client, as, txnID, payload)
+}
@@ -0,0 +1,126 @@
+// Copyright 2018 Vector Creations Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+	appserviceStorage "github.com/matrix-org/dendrite/appservice/storage"
+	"github.com/matrix-org/dendrite/appservice/workers"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/util"
+)
+
+// SetupAppserviceAdminAPI mounts the application service admin endpoints,
+// which let operators see and act on transactions that a worker has given
+// up on delivering, under /_dendrite/admin/appservices/{appserviceID}/deadletter.
+// pool is used to hand a requeued transaction straight back to the live
+// worker instead of only updating the database. Every endpoint is gated
+// behind adminAPIAuthToken (config.AppServiceConfig.AdminAPIAuthToken):
+// these handlers can read and discard a dead-lettered transaction's
+// payload, which may contain arbitrary event content, so unlike the rest
+// of the client-server API they are never safe to expose unauthenticated.
+func SetupAppserviceAdminAPI(
+	r *mux.Router, appserviceDB *appserviceStorage.Database, pool *workers.DeliveryPool, adminAPIAuthToken string,
+) {
+	r.Handle("/_dendrite/admin/appservices/{appserviceID}/deadletter",
+		util.MakeJSONAPI(util.NewJSONRequestHandler(requireAdminAuth(adminAPIAuthToken, func(req *http.Request) util.JSONResponse {
+			return listDeadLetteredTransactions(req, appserviceDB)
+		}))),
+	).Methods(http.MethodGet)
+
+	r.Handle("/_dendrite/admin/appservices/{appserviceID}/deadletter/{txnID}/requeue",
+		util.MakeJSONAPI(util.NewJSONRequestHandler(requireAdminAuth(adminAPIAuthToken, func(req *http.Request) util.JSONResponse {
+			return requeueDeadLetteredTransaction(req, pool)
+		}))),
+	).Methods(http.MethodPost)
+
+	r.Handle("/_dendrite/admin/appservices/{appserviceID}/deadletter/{txnID}",
+		util.MakeJSONAPI(util.NewJSONRequestHandler(requireAdminAuth(adminAPIAuthToken, func(req *http.Request) util.JSONResponse {
+			return dropDeadLetteredTransaction(req, appserviceDB)
+		}))),
+	).Methods(http.MethodDelete)
+}
+
+// requireAdminAuth wraps an admin handler so that it refuses every request
+// unless the caller presents adminAPIAuthToken as "Bearer <token>" in the
+// Authorization header. An empty adminAPIAuthToken means the operator
+// hasn't configured one, so the API is disabled entirely rather than left
+// open.
+func requireAdminAuth(
+	adminAPIAuthToken string, next func(req *http.Request) util.JSONResponse,
+) func(req *http.Request) util.JSONResponse {
+	return func(req *http.Request) util.JSONResponse {
+		if adminAPIAuthToken == "" {
+			return jsonerror.Forbidden("the appservice admin API is disabled: no admin_api_auth_token configured")
+		}
+
+		const prefix = "Bearer "
+		header := req.Header.Get("Authorization")
+		if !strings.HasPrefix(header, prefix) ||
+			subtle.ConstantTimeCompare([]byte(strings.TrimPrefix(header, prefix)), []byte(adminAPIAuthToken)) != 1 {
+			return jsonerror.Forbidden("invalid admin token")
+		}
+
+		return next(req)
+	}
+}
+
+func listDeadLetteredTransactions(req *http.Request, appserviceDB *appserviceStorage.Database) util.JSONResponse {
+	appserviceID := mux.Vars(req)["appserviceID"]
+
+	txns, err := appserviceDB.GetDeadLetteredTransactions(req.Context(), appserviceID)
+	if err != nil {
+		return jsonerror.InternalServerError()
+	}
+
+	return util.JSONResponse{Code: http.StatusOK, JSON: txns}
+}
+
+func requeueDeadLetteredTransaction(req *http.Request, pool *workers.DeliveryPool) util.JSONResponse {
+	vars := mux.Vars(req)
+	appserviceID := vars["appserviceID"]
+
+	txnID, err := strconv.Atoi(vars["txnID"])
+	if err != nil {
+		return util.JSONResponse{Code: http.StatusBadRequest, JSON: jsonerror.BadJSON("invalid txnID")}
+	}
+
+	if err = pool.Requeue(req.Context(), appserviceID, txnID); err != nil {
+		return jsonerror.InternalServerError()
+	}
+
+	return util.JSONResponse{Code: http.StatusOK, JSON: struct{}{}}
+}
+
+func dropDeadLetteredTransaction(req *http.Request, appserviceDB *appserviceStorage.Database) util.JSONResponse {
+	vars := mux.Vars(req)
+	appserviceID := vars["appserviceID"]
+
+	txnID, err := strconv.Atoi(vars["txnID"])
+	if err != nil {
+		return util.JSONResponse{Code: http.StatusBadRequest, JSON: jsonerror.BadJSON("invalid txnID")}
+	}
+
+	if err = appserviceDB.DeleteQueuedTransaction(req.Context(), appserviceID, txnID); err != nil {
+		return jsonerror.InternalServerError()
+	}
+
+	return util.JSONResponse{Code: http.StatusOK, JSON: struct{}{}}
+}
@@ -0,0 +1,63 @@
+// Copyright 2018 Vector Creations Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import "runtime"
+
+// ApplicationService represents a configured application service.
+type ApplicationService struct {
+	ID              string   `yaml:"id"`
+	URL             string   `yaml:"url"`
+	ASToken         string   `yaml:"as_token"`
+	HSToken         string   `yaml:"hs_token"`
+	SenderLocalpart string   `yaml:"sender_localpart"`
+	RateLimited     bool     `yaml:"rate_limited"`
+	Protocols       []string `yaml:"protocols"`
+	// Transport selects how transactions are delivered to this AS: "http"
+	// (the default, also used when URL has a unix:// scheme) or "broker" to
+	// publish transactions to a message broker subject instead of making an
+	// HTTP request. "broker" falls back to HTTP when the delivery pool has no
+	// broker publisher set.
+	Transport string `yaml:"transport"`
+	// BrokerSubject is the NATS/Kafka subject transactions are published to
+	// when Transport is "broker".
+	BrokerSubject string `yaml:"broker_subject"`
+}
+
+// AppServiceConfig is the configuration for the appservice component as a
+// whole, as opposed to a single configured application service.
+type AppServiceConfig struct {
+	// DeliveryWorkers is the number of goroutines used to send transactions
+	// to application services. Delivery to a single application service is
+	// always serialized to preserve ordering, but this many ASes may be
+	// delivered to concurrently. Defaults to runtime.NumCPU() when unset.
+	DeliveryWorkers int `yaml:"delivery_workers"`
+	// AdminAPIAuthToken gates the appservice admin API (listing, requeuing
+	// and dropping dead-lettered transactions) behind a shared secret.
+	// Callers must present it as "Bearer <token>" in the Authorization
+	// header. Left unset, the admin API refuses every request rather than
+	// running unauthenticated, since dead-lettered transactions can carry
+	// arbitrary event content.
+	AdminAPIAuthToken string `yaml:"admin_api_auth_token"`
+}
+
+// DeliveryWorkerCount returns the configured number of delivery workers,
+// falling back to runtime.NumCPU() if none was configured.
+func (c AppServiceConfig) DeliveryWorkerCount() int {
+	if c.DeliveryWorkers > 0 {
+		return c.DeliveryWorkers
+	}
+	return runtime.NumCPU()
+}